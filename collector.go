@@ -0,0 +1,131 @@
+package main // GPU Monitor, feed data to influxdb
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// GPUUtilization stores GPU resource usage summary, in percent
+type GPUUtilization struct {
+	GPUUtil     int64
+	MemoryUtil  int64
+	EncoderUtil int64
+	DecoderUtil int64
+}
+
+// MemoryUsage shows total, used and free memory space, in bytes
+type MemoryUsage struct {
+	Total int64
+	Used  int64
+	Free  int64
+}
+
+// ProcessInfo is a single entry of the per-process GPU accounting info, i.e.
+// one PID currently holding a context open on the card.
+type ProcessInfo struct {
+	PID string
+	// ProcessName is the executable name nvidia-smi reports for the PID.
+	ProcessName string
+	// UsedMemory is the process's own FB memory usage, in bytes.
+	UsedMemory int64
+	// Type is "C" (compute) or "G" (graphics), as reported by nvidia-smi.
+	Type string
+}
+
+// MIGInfo describes one Multi-Instance GPU partition of a physical card,
+// with its own utilization and memory accounting.
+type MIGInfo struct {
+	UUID          string
+	GPUInstanceID string
+	FBMemoryUsage MemoryUsage
+	Utilization   GPUUtilization
+}
+
+// GPUInfo shows per GPU card spec and status, normalized across backends
+type GPUInfo struct {
+	ID           string
+	ProductName  string
+	ProductBrand string
+	UUID         string
+	// MinorNumber is the /dev/nvidiaN character-device minor number on the
+	// xml and nvml backends. The csv backend has no query-gpu property for
+	// it and falls back to the nvidia-smi enumeration index instead, which
+	// is usually but not guaranteedly the same number - see the comment on
+	// csvCollector.parseRow.
+	MinorNumber     int32
+	FBMemoryUsage   MemoryUsage
+	Bar1MemoryUsage MemoryUsage
+	Utilization     GPUUtilization
+	// Fields unavailable from the legacy XML backend, populated by nvml/csv
+	PowerDrawWatts   float64
+	TemperatureC     float64
+	FanSpeedPercent  float64
+	ClockSMMHz       int64
+	ClockMemoryMHz   int64
+	PerformanceState string
+	// Processes currently holding a context on this GPU. Empty when the
+	// backend doesn't support per-process accounting or none are running.
+	Processes []ProcessInfo
+	// MIGDevices lists the MIG partitions of this GPU, if MIG mode is
+	// enabled and the driver is new enough to report it.
+	MIGDevices []MIGInfo
+	// MetricsPresent marks which optional fields above (plus bar1memory,
+	// encoder.util and decoder.util) this particular GPUInfo actually got a
+	// real reading for, keyed by csvMetricRegistry property name where one
+	// exists. Every collector must set this explicitly for whatever it
+	// populates - an absent/false entry means "don't write a point for
+	// this", so a backend that doesn't support a field can't accidentally
+	// have a zero value mistaken for a real reading.
+	MetricsPresent map[string]bool
+}
+
+// Collector abstracts over the different ways we can gather GPU telemetry
+// (NVML bindings, nvidia-smi CSV output, nvidia-smi XML output), returning a
+// normalized snapshot so callers never need to know which one is in use.
+type Collector interface {
+	Collect() ([]GPUInfo, error)
+}
+
+// NewCollector builds the Collector for the requested backend. "nvml" is
+// tried first when requested and transparently falls back to "csv" and then
+// "xml" if the NVML bindings were not compiled in or fail to initialize, so
+// a host without a working NVML library still gets metrics. csvMetrics
+// selects which optional properties the csv backend queries (see
+// csvMetricRegistry); it is ignored by the nvml and xml backends.
+func NewCollector(backend string, csvMetrics []string) (Collector, error) {
+	if err := validateCSVMetrics(csvMetrics); err != nil {
+		return nil, err
+	}
+	switch backend {
+	case "nvml":
+		if c, err := newNVMLCollector(); err == nil {
+			return c, nil
+		}
+		glog.Warningf("nvml backend unavailable, falling back to csv")
+		fallthrough
+	case "csv":
+		if c, err := newCSVCollectorWithMetrics(csvMetrics); err == nil {
+			return c, nil
+		}
+		glog.Warningf("csv backend unavailable, falling back to xml")
+		fallthrough
+	case "xml":
+		return newXMLCollector(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q, want one of nvml, csv, xml", backend)
+	}
+}
@@ -0,0 +1,161 @@
+package main // GPU Monitor, feed data to influxdb
+
+import (
+	"encoding/csv"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// csvCollector runs `nvidia-smi --query-gpu=... --format=csv` once per
+// scrape instead of parsing the much slower and less complete `-q -x` XML
+// report. It is the default fallback when the nvml backend is unavailable.
+// The set of optional properties it queries (beyond the identity fields
+// index/uuid/name, which are always fetched) is configurable via the
+// -metrics flag so operators can trim cardinality or work around fields
+// their driver doesn't populate.
+type csvCollector struct {
+	// fields is csvIdentityFields followed by the validated -metrics list as
+	// given (duplicates are not removed), in the order passed to --query-gpu.
+	fields []string
+}
+
+// newCSVCollectorWithMetrics builds a csvCollector that queries
+// csvIdentityFields plus the given metric properties. metrics must already
+// be validated against csvMetricRegistry.
+func newCSVCollectorWithMetrics(metrics []string) (*csvCollector, error) {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return nil, err
+	}
+	fields := append(append([]string{}, csvIdentityFields...), metrics...)
+	return &csvCollector{fields: fields}, nil
+}
+
+func (c *csvCollector) Collect() ([]GPUInfo, error) {
+	args := []string{
+		"--query-gpu=" + strings.Join(c.fields, ","),
+		"--format=csv,noheader,nounits",
+	}
+	out, err := exec.Command("nvidia-smi", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]GPUInfo, 0, len(rows))
+	for _, row := range rows {
+		infos = append(infos, c.parseRow(row))
+	}
+	return infos, nil
+}
+
+// parseRow turns one CSV row (in the column order of c.fields) into a
+// GPUInfo, trimming the whitespace nvidia-smi pads each field with and
+// recording in MetricsPresent which queried properties actually parsed
+// (as opposed to a "[N/A]"/"[Not Supported]" sentinel).
+func (c *csvCollector) parseRow(row []string) GPUInfo {
+	get := func(name string) (string, bool) {
+		for i, f := range c.fields {
+			if f == name {
+				if i >= len(row) {
+					return "", false
+				}
+				return strings.TrimSpace(row[i]), true
+			}
+		}
+		return "", false
+	}
+	present := map[string]bool{}
+	getInt := func(name string) int64 {
+		s, queried := get(name)
+		v, ok := parseCSVInt(s)
+		if queried && ok {
+			present[name] = true
+		}
+		return v
+	}
+	getFloat := func(name string) float64 {
+		s, queried := get(name)
+		v, ok := parseCSVFloat(s)
+		if queried && ok {
+			present[name] = true
+		}
+		return v
+	}
+	indexStr, _ := get("index")
+	uuid, _ := get("uuid")
+	name, _ := get("name")
+	pstate, pstateQueried := get("pstate")
+	if pstateQueried && pstate != "" && !strings.HasPrefix(pstate, "[") {
+		present["pstate"] = true
+	}
+
+	return GPUInfo{
+		ID:          indexStr,
+		UUID:        uuid,
+		ProductName: name,
+		// nvidia-smi's --query-gpu has no minor-number property, only
+		// "index" (the enumeration order nvidia-smi lists cards in). That
+		// usually matches the /dev/nvidiaN minor number but isn't
+		// guaranteed to - e.g. under a reordering CUDA_VISIBLE_DEVICES. The
+		// xml and nvml backends report the real minor number instead, so a
+		// `minor` tag/label is not necessarily a stable join key across a
+		// `-backend` switch on the same host.
+		MinorNumber: int32(parseCSVIntOrZero(indexStr)),
+		FBMemoryUsage: MemoryUsage{
+			Total: getInt("memory.total") * 1024 * 1024,
+			Used:  getInt("memory.used") * 1024 * 1024,
+			Free:  getInt("memory.free") * 1024 * 1024,
+		},
+		Utilization: GPUUtilization{
+			GPUUtil:    getInt("utilization.gpu"),
+			MemoryUtil: getInt("utilization.memory"),
+		},
+		PowerDrawWatts:   getFloat("power.draw"),
+		TemperatureC:     getFloat("temperature.gpu"),
+		FanSpeedPercent:  getFloat("fan.speed"),
+		ClockSMMHz:       getInt("clocks.current.sm"),
+		ClockMemoryMHz:   getInt("clocks.current.memory"),
+		PerformanceState: pstate,
+		MetricsPresent:   present,
+	}
+}
+
+func parseCSVIntOrZero(s string) int64 {
+	v, _ := parseCSVInt(s)
+	return v
+}
+
+// parseCSVInt parses a CSV field, returning ok=false for nvidia-smi's
+// "[N/A]"/"[Not Supported]" sentinels and any other unparseable value so
+// the caller can skip the point rather than write a misleading zero.
+func parseCSVInt(s string) (int64, bool) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+func parseCSVFloat(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
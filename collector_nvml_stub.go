@@ -0,0 +1,31 @@
+//go:build !nvml
+
+package main // GPU Monitor, feed data to influxdb
+
+import "fmt"
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// nvmlCollector is unavailable in this build: the binary was built without
+// `-tags nvml`, so it has no CGO dependency on libnvidia-ml. NewCollector
+// falls back to the csv backend when this error is returned.
+type nvmlCollector struct{}
+
+func newNVMLCollector() (*nvmlCollector, error) {
+	return nil, fmt.Errorf("nvml backend not compiled in, rebuild with -tags nvml")
+}
+
+func (c *nvmlCollector) Collect() ([]GPUInfo, error) {
+	return nil, fmt.Errorf("nvml backend not compiled in, rebuild with -tags nvml")
+}
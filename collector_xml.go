@@ -0,0 +1,208 @@
+package main // GPU Monitor, feed data to influxdb
+
+import (
+	"encoding/xml"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// xmlGPUUtilization mirrors the <utilization> section of `nvidia-smi -q -x`
+type xmlGPUUtilization struct {
+	GPUUtil     string `xml:"gpu_util"`
+	MemoryUtil  string `xml:"memory_util"`
+	EncoderUtil string `xml:"encoder_util"`
+	DecoderUtil string `xml:"decoder_util"`
+}
+
+// xmlMemoryUsage mirrors a <xxx_memory_usage> section of `nvidia-smi -q -x`
+type xmlMemoryUsage struct {
+	Total string `xml:"total"`
+	Used  string `xml:"used"`
+	Free  string `xml:"free"`
+}
+
+// xmlProcessInfo mirrors one <process_info> entry of the <processes> section
+// of `nvidia-smi -q -x`. On drivers/cards with no running processes,
+// nvidia-smi reports the whole <processes> section as the literal text
+// "N/A" instead of omitting it, which xml.Unmarshal leaves as a zero-value
+// slice for us - no special casing needed here.
+type xmlProcessInfo struct {
+	PID         string `xml:"pid"`
+	ProcessName string `xml:"process_name"`
+	UsedMemory  string `xml:"used_memory"`
+	Type        string `xml:"type"`
+}
+
+// xmlMIGDevice mirrors one <mig_device> entry of the <mig_devices> section,
+// only present on MIG-capable cards with MIG mode enabled. Older drivers
+// omit <mig_devices> entirely, which leaves this as a zero-length slice.
+type xmlMIGDevice struct {
+	UUID          string            `xml:"uuid"`
+	GPUInstanceID string            `xml:"gpu_instance_id"`
+	FBMemoryUsage xmlMemoryUsage    `xml:"fb_memory_usage"`
+	Utilization   xmlGPUUtilization `xml:"utilization"`
+}
+
+// xmlGPUInfo mirrors a single <gpu> section of `nvidia-smi -q -x`
+type xmlGPUInfo struct {
+	ID           string `xml:"id,attr"`
+	ProductName  string `xml:"product_name"`
+	ProductBrand string `xml:"product_brand"`
+	UUID         string `xml:"uuid"`
+	// Device Minor Number
+	MinorNumber     int32             `xml:"minor_number"`
+	FBMemoryUsage   xmlMemoryUsage    `xml:"fb_memory_usage"`
+	Bar1MemoryUsage xmlMemoryUsage    `xml:"bar1_memory_usage"`
+	Utilization     xmlGPUUtilization `xml:"utilization"`
+	Processes       []xmlProcessInfo  `xml:"processes>process_info"`
+	MIGDevices      []xmlMIGDevice    `xml:"mig_devices>mig_device"`
+}
+
+// xmlNvidiaSmiLog mirrors the root of `nvidia-smi -q -x` output
+type xmlNvidiaSmiLog struct {
+	// Nvidia driver version
+	DriverVersion string `xml:"driver_version"`
+	// Attached GPU Count.
+	AttachedGPUs string `xml:"attached_gpus"`
+	// GPUinfo
+	GPUInfoList []xmlGPUInfo `xml:"gpu"`
+}
+
+func memUsage2Int(usage string) int64 {
+	// convert string like 11519 MiB to bytes
+	if strings.HasSuffix(usage, " MiB") {
+		mega := strings.Replace(usage, " MiB", "", -1)
+		megaInt, _ := strconv.ParseInt(mega, 10, 64)
+		// FIXME: return parse error
+		return megaInt * 1024 * 1024
+	}
+	return 0
+}
+
+func utilization2Float(utilization string) int64 {
+	// convert string like 83 % to float point data
+	if strings.HasSuffix(utilization, " %") {
+		ut := strings.Replace(utilization, " %", "", -1)
+		utInt, _ := strconv.ParseInt(ut, 10, 64)
+		// FIXME: return parse error
+		return utInt
+	}
+	return 0
+}
+
+// xmlCollector is the last-resort backend: it shells out to `nvidia-smi -q
+// -x` and parses the XML report. It is the slowest backend (one process
+// spawn per scrape) and cannot report power/temperature/fan/clock/pstate
+// metrics, but it works wherever nvidia-smi is installed.
+type xmlCollector struct{}
+
+func newXMLCollector() *xmlCollector {
+	return &xmlCollector{}
+}
+
+func (c *xmlCollector) Collect() ([]GPUInfo, error) {
+	out, err := exec.Command("nvidia-smi", "-q", "-x").Output()
+	if err != nil {
+		return nil, err
+	}
+	var log xmlNvidiaSmiLog
+	if err := xml.Unmarshal(out, &log); err != nil {
+		return nil, err
+	}
+	infos := make([]GPUInfo, 0, len(log.GPUInfoList))
+	for _, g := range log.GPUInfoList {
+		infos = append(infos, GPUInfo{
+			ID:           g.ID,
+			ProductName:  g.ProductName,
+			ProductBrand: g.ProductBrand,
+			UUID:         g.UUID,
+			MinorNumber:  g.MinorNumber,
+			FBMemoryUsage: MemoryUsage{
+				Total: memUsage2Int(g.FBMemoryUsage.Total),
+				Used:  memUsage2Int(g.FBMemoryUsage.Used),
+				Free:  memUsage2Int(g.FBMemoryUsage.Free),
+			},
+			Bar1MemoryUsage: MemoryUsage{
+				Total: memUsage2Int(g.Bar1MemoryUsage.Total),
+				Used:  memUsage2Int(g.Bar1MemoryUsage.Used),
+				Free:  memUsage2Int(g.Bar1MemoryUsage.Free),
+			},
+			Utilization: GPUUtilization{
+				GPUUtil:     utilization2Float(g.Utilization.GPUUtil),
+				MemoryUtil:  utilization2Float(g.Utilization.MemoryUtil),
+				EncoderUtil: utilization2Float(g.Utilization.EncoderUtil),
+				DecoderUtil: utilization2Float(g.Utilization.DecoderUtil),
+			},
+			Processes:  convertXMLProcesses(g.Processes),
+			MIGDevices: convertXMLMIGDevices(g.MIGDevices),
+			MetricsPresent: map[string]bool{
+				"memory.total":       true,
+				"memory.used":        true,
+				"memory.free":        true,
+				"bar1memory":         true,
+				"utilization.gpu":    true,
+				"utilization.memory": true,
+				"encoder.util":       true,
+				"decoder.util":       true,
+			},
+		})
+	}
+	return infos, nil
+}
+
+// convertXMLProcesses normalizes the <processes> section, skipping any
+// <process_info> whose PID is empty or "N/A" rather than emitting a bogus
+// process point for it.
+func convertXMLProcesses(procs []xmlProcessInfo) []ProcessInfo {
+	out := make([]ProcessInfo, 0, len(procs))
+	for _, p := range procs {
+		if p.PID == "" || p.PID == "N/A" {
+			continue
+		}
+		out = append(out, ProcessInfo{
+			PID:         p.PID,
+			ProcessName: p.ProcessName,
+			UsedMemory:  memUsage2Int(p.UsedMemory),
+			Type:        p.Type,
+		})
+	}
+	return out
+}
+
+// convertXMLMIGDevices normalizes the <mig_devices> section, absent
+// altogether on drivers that predate MIG or cards with MIG mode disabled.
+func convertXMLMIGDevices(devs []xmlMIGDevice) []MIGInfo {
+	out := make([]MIGInfo, 0, len(devs))
+	for _, d := range devs {
+		out = append(out, MIGInfo{
+			UUID:          d.UUID,
+			GPUInstanceID: d.GPUInstanceID,
+			FBMemoryUsage: MemoryUsage{
+				Total: memUsage2Int(d.FBMemoryUsage.Total),
+				Used:  memUsage2Int(d.FBMemoryUsage.Used),
+				Free:  memUsage2Int(d.FBMemoryUsage.Free),
+			},
+			Utilization: GPUUtilization{
+				GPUUtil:     utilization2Float(d.Utilization.GPUUtil),
+				MemoryUtil:  utilization2Float(d.Utilization.MemoryUtil),
+				EncoderUtil: utilization2Float(d.Utilization.EncoderUtil),
+				DecoderUtil: utilization2Float(d.Utilization.DecoderUtil),
+			},
+		})
+	}
+	return out
+}
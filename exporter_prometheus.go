@@ -0,0 +1,177 @@
+package main // GPU Monitor, feed data to influxdb
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/golang/glog"
+)
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+var (
+	gpuUtilDesc = prometheus.NewDesc(
+		"gpumon_gpu_utilization_percent", "GPU compute utilization in percent.",
+		gpuLabelNames, nil)
+	gpuMemUtilDesc = prometheus.NewDesc(
+		"gpumon_memory_utilization_percent", "GPU memory controller utilization in percent.",
+		gpuLabelNames, nil)
+	gpuFBMemUsedDesc = prometheus.NewDesc(
+		"gpumon_fb_memory_used_bytes", "Framebuffer memory in use, in bytes.",
+		gpuLabelNames, nil)
+	gpuFBMemTotalDesc = prometheus.NewDesc(
+		"gpumon_fb_memory_total_bytes", "Total framebuffer memory, in bytes.",
+		gpuLabelNames, nil)
+	gpuBar1MemUsedDesc = prometheus.NewDesc(
+		"gpumon_bar1_memory_used_bytes", "BAR1 memory in use, in bytes.",
+		gpuLabelNames, nil)
+	gpuBar1MemTotalDesc = prometheus.NewDesc(
+		"gpumon_bar1_memory_total_bytes", "Total BAR1 memory, in bytes.",
+		gpuLabelNames, nil)
+	gpuBar1MemFreeDesc = prometheus.NewDesc(
+		"gpumon_bar1_memory_free_bytes", "Free BAR1 memory, in bytes.",
+		gpuLabelNames, nil)
+	gpuEncoderUtilDesc = prometheus.NewDesc(
+		"gpumon_encoder_utilization_percent", "Video encoder utilization in percent.",
+		gpuLabelNames, nil)
+	gpuDecoderUtilDesc = prometheus.NewDesc(
+		"gpumon_decoder_utilization_percent", "Video decoder utilization in percent.",
+		gpuLabelNames, nil)
+	gpuClockSMDesc = prometheus.NewDesc(
+		"gpumon_sm_clock_mhz", "Current SM clock in MHz.",
+		gpuLabelNames, nil)
+	gpuClockMemoryDesc = prometheus.NewDesc(
+		"gpumon_memory_clock_mhz", "Current memory clock in MHz.",
+		gpuLabelNames, nil)
+	gpuPowerDrawDesc = prometheus.NewDesc(
+		"gpumon_power_draw_watts", "Board power draw in watts.",
+		gpuLabelNames, nil)
+	gpuTemperatureDesc = prometheus.NewDesc(
+		"gpumon_temperature_celsius", "GPU die temperature in Celsius.",
+		gpuLabelNames, nil)
+	gpuFanSpeedDesc = prometheus.NewDesc(
+		"gpumon_fan_speed_percent", "Fan speed in percent of max.",
+		gpuLabelNames, nil)
+	// gpuPstateInfoDesc is an info-style metric (constant value 1, state
+	// carried entirely in the "pstate" label) since a P-state like "P0" has
+	// no sensible numeric value of its own.
+	gpuPstateInfoDesc = prometheus.NewDesc(
+		"gpumon_pstate_info", "GPU performance state; always 1, state is in the pstate label.",
+		append(append([]string{}, gpuLabelNames...), "pstate"), nil)
+)
+
+// gpuLabelNames is {hostname, gpuid, uuid, product, minor}: the InfluxDB
+// tag set (hostname, gpuid, product, minor) plus uuid, which the InfluxDB
+// points do not carry.
+var gpuLabelNames = []string{"hostname", "gpuid", "uuid", "product", "minor"}
+
+// prometheusExporter implements prometheus.Collector by reading the latest
+// snapshot on every scrape, rather than shelling out to nvidia-smi or
+// talking to NVML itself.
+type prometheusExporter struct {
+	hostname string
+	snapshot *gpuSnapshot
+}
+
+func newPrometheusExporter(hostname string, snapshot *gpuSnapshot) *prometheusExporter {
+	return &prometheusExporter{hostname: hostname, snapshot: snapshot}
+}
+
+func (e *prometheusExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gpuUtilDesc
+	ch <- gpuMemUtilDesc
+	ch <- gpuFBMemUsedDesc
+	ch <- gpuFBMemTotalDesc
+	ch <- gpuBar1MemUsedDesc
+	ch <- gpuBar1MemTotalDesc
+	ch <- gpuBar1MemFreeDesc
+	ch <- gpuEncoderUtilDesc
+	ch <- gpuDecoderUtilDesc
+	ch <- gpuClockSMDesc
+	ch <- gpuClockMemoryDesc
+	ch <- gpuPowerDrawDesc
+	ch <- gpuTemperatureDesc
+	ch <- gpuFanSpeedDesc
+	ch <- gpuPstateInfoDesc
+}
+
+func (e *prometheusExporter) Collect(ch chan<- prometheus.Metric) {
+	for _, gpustat := range e.snapshot.Get() {
+		labels := []string{
+			e.hostname,
+			gpustat.ID,
+			gpustat.UUID,
+			gpustat.ProductName,
+			strconv.Itoa(int(gpustat.MinorNumber)),
+		}
+		if gpustat.MetricsPresent["utilization.gpu"] {
+			ch <- prometheus.MustNewConstMetric(gpuUtilDesc, prometheus.GaugeValue, float64(gpustat.Utilization.GPUUtil), labels...)
+		}
+		if gpustat.MetricsPresent["utilization.memory"] {
+			ch <- prometheus.MustNewConstMetric(gpuMemUtilDesc, prometheus.GaugeValue, float64(gpustat.Utilization.MemoryUtil), labels...)
+		}
+		if gpustat.MetricsPresent["memory.used"] {
+			ch <- prometheus.MustNewConstMetric(gpuFBMemUsedDesc, prometheus.GaugeValue, float64(gpustat.FBMemoryUsage.Used), labels...)
+		}
+		if gpustat.MetricsPresent["memory.total"] {
+			ch <- prometheus.MustNewConstMetric(gpuFBMemTotalDesc, prometheus.GaugeValue, float64(gpustat.FBMemoryUsage.Total), labels...)
+		}
+		if gpustat.MetricsPresent["bar1memory"] {
+			ch <- prometheus.MustNewConstMetric(gpuBar1MemUsedDesc, prometheus.GaugeValue, float64(gpustat.Bar1MemoryUsage.Used), labels...)
+			ch <- prometheus.MustNewConstMetric(gpuBar1MemTotalDesc, prometheus.GaugeValue, float64(gpustat.Bar1MemoryUsage.Total), labels...)
+			ch <- prometheus.MustNewConstMetric(gpuBar1MemFreeDesc, prometheus.GaugeValue, float64(gpustat.Bar1MemoryUsage.Free), labels...)
+		}
+		if gpustat.MetricsPresent["encoder.util"] {
+			ch <- prometheus.MustNewConstMetric(gpuEncoderUtilDesc, prometheus.GaugeValue, float64(gpustat.Utilization.EncoderUtil), labels...)
+		}
+		if gpustat.MetricsPresent["decoder.util"] {
+			ch <- prometheus.MustNewConstMetric(gpuDecoderUtilDesc, prometheus.GaugeValue, float64(gpustat.Utilization.DecoderUtil), labels...)
+		}
+		if gpustat.MetricsPresent["clocks.current.sm"] {
+			ch <- prometheus.MustNewConstMetric(gpuClockSMDesc, prometheus.GaugeValue, float64(gpustat.ClockSMMHz), labels...)
+		}
+		if gpustat.MetricsPresent["clocks.current.memory"] {
+			ch <- prometheus.MustNewConstMetric(gpuClockMemoryDesc, prometheus.GaugeValue, float64(gpustat.ClockMemoryMHz), labels...)
+		}
+		if gpustat.MetricsPresent["power.draw"] {
+			ch <- prometheus.MustNewConstMetric(gpuPowerDrawDesc, prometheus.GaugeValue, gpustat.PowerDrawWatts, labels...)
+		}
+		if gpustat.MetricsPresent["temperature.gpu"] {
+			ch <- prometheus.MustNewConstMetric(gpuTemperatureDesc, prometheus.GaugeValue, gpustat.TemperatureC, labels...)
+		}
+		if gpustat.MetricsPresent["fan.speed"] {
+			ch <- prometheus.MustNewConstMetric(gpuFanSpeedDesc, prometheus.GaugeValue, gpustat.FanSpeedPercent, labels...)
+		}
+		if gpustat.MetricsPresent["pstate"] {
+			pstateLabels := append(append([]string{}, labels...), gpustat.PerformanceState)
+			ch <- prometheus.MustNewConstMetric(gpuPstateInfoDesc, prometheus.GaugeValue, 1, pstateLabels...)
+		}
+	}
+}
+
+// servePrometheus registers the exporter and blocks serving /metrics on
+// addr. Call it in its own goroutine.
+func servePrometheus(addr string, hostname string, snapshot *gpuSnapshot) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newPrometheusExporter(hostname, snapshot))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	glog.Infof("serving prometheus metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Fatalf("prometheus http server error: %v", err)
+	}
+}
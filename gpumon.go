@@ -1,15 +1,11 @@
 package main // GPU Monitor, feed data to influxdb
 import (
 	"bytes"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	urlquery "net/url"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
@@ -29,79 +25,6 @@ import (
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// GPUUtilization stores GPU resource usage summary
-type GPUUtilization struct {
-	GPUUtil     string `xml:"gpu_util"`
-	MemoryUtil  string `xml:"memory_util"`
-	EncoderUtil string `xml:"encoder_util"`
-	DecoderUtil string `xml:"decoder_util"`
-}
-
-// MemoryUsage shows total, used and free memory space
-type MemoryUsage struct {
-	Total string `xml:"total"`
-	Used  string `xml:"used"`
-	Free  string `xml:"free"`
-}
-
-// GPUInfo shows per GPU card spec and status
-type GPUInfo struct {
-	ID           string `xml:"id,attr"`
-	ProductName  string `xml:"product_name"`
-	ProductBrand string `xml:"product_brand"`
-	UUID         string `xml:"uuid"`
-	// Device Minor Number
-	MinorNumber     int32          `xml:"minor_number"`
-	FBMemoryUsage   MemoryUsage    `xml:"fb_memory_usage"`
-	Bar1MemoryUsage MemoryUsage    `xml:"bar1_memory_usage"`
-	Utilization     GPUUtilization `xml:"utilization"`
-}
-
-// NvidiaSmiLog describe nvidia-smi output
-type NvidiaSmiLog struct {
-	// Nvidia driver version
-	DriverVersion string `xml:"driver_version"`
-	// Attached GPU Count.
-	AttachedGPUs string `xml:"attached_gpus"`
-	// GPUinfo
-	GPUInfoList []GPUInfo `xml:"gpu"`
-}
-
-func memUsage2Int(usage string) int64 {
-	// convert string like 11519 MiB to bytes
-	if strings.HasSuffix(usage, " MiB") {
-		mega := strings.Replace(usage, " MiB", "", -1)
-		megaInt, _ := strconv.ParseInt(mega, 10, 64)
-		// FIXME: return parse error
-		return megaInt * 1024 * 1024
-	}
-	return 0
-}
-
-func utilization2Float(utilization string) int64 {
-	// convert string like 83 % to float point data
-	if strings.HasSuffix(utilization, " %") {
-		ut := strings.Replace(utilization, " %", "", -1)
-		utInt, _ := strconv.ParseInt(ut, 10, 64)
-		// FIXME: return parse error
-		return utInt
-	}
-	return 0
-}
-
-func getGPUInfo() (*NvidiaSmiLog, error) {
-	out, err := exec.Command("nvidia-smi", "-q", "-x").Output()
-	if err != nil {
-		return nil, err
-	}
-	nvidiasmilog := NvidiaSmiLog{}
-	err = xml.Unmarshal([]byte(out), &nvidiasmilog)
-	if err != nil {
-		return nil, err
-	}
-	return &nvidiasmilog, err
-}
-
 func getURL(url string) (int, string) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -118,68 +41,187 @@ func getURL(url string) (int, string) {
 	return resp.StatusCode, string(body)
 }
 
-func postURL(url string, plainpost string) {
-	glog.Infof("posting: %s", plainpost)
-	resp, err := http.Post(url, "plain/text", strings.NewReader(plainpost))
-	if err != nil {
-		glog.Errorf("post error: %s", err)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		glog.Errorf("error read response %s", err)
+func appendPoint(output *bytes.Buffer, mesurement string, tags string, value int64, timestamp int64) {
+	if output.Len() > 0 {
+		output.WriteString("\n")
 	}
-	glog.Infof("response status[%d] %s", resp.StatusCode, body)
+	output.WriteString(fmt.Sprintf("%s,%s value=%d %d", mesurement, tags, value, timestamp))
 }
 
-func appendPoint(output *bytes.Buffer, mesurement string, tags string, value int64, timestamp int64) {
+func appendFloatPoint(output *bytes.Buffer, mesurement string, tags string, value float64, timestamp int64) {
 	if output.Len() > 0 {
 		output.WriteString("\n")
 	}
-	output.WriteString(fmt.Sprintf("%s,%s value=%d %d", mesurement, tags, value, timestamp))
+	output.WriteString(fmt.Sprintf("%s,%s value=%g %d", mesurement, tags, value, timestamp))
 }
 
-func postToInfluxdb(xmlinfo *NvidiaSmiLog, baseurl string, hostname string, timestamp int64) {
-	//create dababase if not exist
-	var postbuffer bytes.Buffer
-	url := baseurl + "query?q=CREATE%20DATABASE%20GPU"
-	code, body := getURL(url)
-	if code != 200 {
-		glog.Errorf("create database faild, code %d, %s", code, body)
+// appendStringPoint appends a point whose field is a line-protocol string
+// (quoted, with internal quotes/backslashes escaped) rather than a number -
+// used for enum-like readings such as the GPU's current performance state.
+func appendStringPoint(output *bytes.Buffer, mesurement string, tags string, field string, value string, timestamp int64) {
+	if output.Len() > 0 {
+		output.WriteString("\n")
 	}
-	writeurl := baseurl + "write?db=GPU"
-	for _, gpustat := range xmlinfo.GPUInfoList {
-		postbuffer.Reset()
+	output.WriteString(fmt.Sprintf("%s,%s %s=%q %d", mesurement, tags, field, value, timestamp))
+}
+
+// metricPresent reports whether gpustat carries a real reading for the
+// given property (a csvMetricRegistry name, or one of "bar1memory",
+// "encoder.util", "decoder.util" which have no csv equivalent). Every
+// collector sets MetricsPresent explicitly for whatever it populates, so a
+// missing entry here means "don't write a point for this" rather than
+// "assume it's fine" - that's what lets a backend that doesn't support a
+// field skip it instead of writing a misleading zero.
+func metricPresent(gpustat GPUInfo, property string) bool {
+	return gpustat.MetricsPresent[property]
+}
+
+// buildInfluxLines renders one scrape's worth of GPUInfo into line-protocol
+// points. It does no I/O itself; the caller hands the result to an
+// influxClient to batch and send.
+func buildInfluxLines(infos []GPUInfo, hostname string, timestamp int64) []string {
+	var buf bytes.Buffer
+	var lines []string
+	for _, gpustat := range infos {
+		buf.Reset()
 		tags := fmt.Sprintf("hostname=%s,gpuid=%s,product=%s,minor=%d",
-			hostname, gpustat.ID, urlquery.QueryEscape(gpustat.ProductName), gpustat.MinorNumber)
+			hostname, gpustat.ID, escapeLineProtocolTag(gpustat.ProductName), gpustat.MinorNumber)
 		// FB
-		appendPoint(&postbuffer, "fbmemory/total", tags, memUsage2Int(gpustat.FBMemoryUsage.Total), timestamp)
-		appendPoint(&postbuffer, "fbmemory/used", tags, memUsage2Int(gpustat.FBMemoryUsage.Used), timestamp)
-		appendPoint(&postbuffer, "fbmemory/free", tags, memUsage2Int(gpustat.FBMemoryUsage.Free), timestamp)
-		// BAR1
-		appendPoint(&postbuffer, "bar1memory/total", tags, memUsage2Int(gpustat.Bar1MemoryUsage.Total), timestamp)
-		appendPoint(&postbuffer, "bar1memory/used", tags, memUsage2Int(gpustat.Bar1MemoryUsage.Used), timestamp)
-		appendPoint(&postbuffer, "bar1memory/free", tags, memUsage2Int(gpustat.Bar1MemoryUsage.Free), timestamp)
+		if metricPresent(gpustat, "memory.total") {
+			appendPoint(&buf, "fbmemory/total", tags, gpustat.FBMemoryUsage.Total, timestamp)
+		}
+		if metricPresent(gpustat, "memory.used") {
+			appendPoint(&buf, "fbmemory/used", tags, gpustat.FBMemoryUsage.Used, timestamp)
+		}
+		if metricPresent(gpustat, "memory.free") {
+			appendPoint(&buf, "fbmemory/free", tags, gpustat.FBMemoryUsage.Free, timestamp)
+		}
+		// BAR1 - only the xml backend actually reads this section
+		if metricPresent(gpustat, "bar1memory") {
+			appendPoint(&buf, "bar1memory/total", tags, gpustat.Bar1MemoryUsage.Total, timestamp)
+			appendPoint(&buf, "bar1memory/used", tags, gpustat.Bar1MemoryUsage.Used, timestamp)
+			appendPoint(&buf, "bar1memory/free", tags, gpustat.Bar1MemoryUsage.Free, timestamp)
+		}
 		// Utilizations
-		appendPoint(&postbuffer, "gpu", tags, utilization2Float(gpustat.Utilization.GPUUtil), timestamp)
-		appendPoint(&postbuffer, "gpu/encoder", tags, utilization2Float(gpustat.Utilization.EncoderUtil), timestamp)
-		appendPoint(&postbuffer, "gpu/decoder", tags, utilization2Float(gpustat.Utilization.DecoderUtil), timestamp)
-		// Post these points to influxdb
-		postURL(writeurl, postbuffer.String())
+		if metricPresent(gpustat, "utilization.gpu") {
+			appendPoint(&buf, "gpu", tags, gpustat.Utilization.GPUUtil, timestamp)
+		}
+		if metricPresent(gpustat, "utilization.memory") {
+			appendPoint(&buf, csvMetricRegistry["utilization.memory"], tags, gpustat.Utilization.MemoryUtil, timestamp)
+		}
+		if metricPresent(gpustat, "encoder.util") {
+			appendPoint(&buf, "gpu/encoder", tags, gpustat.Utilization.EncoderUtil, timestamp)
+		}
+		if metricPresent(gpustat, "decoder.util") {
+			appendPoint(&buf, "gpu/decoder", tags, gpustat.Utilization.DecoderUtil, timestamp)
+		}
+		// Power, thermal and clock metrics (nvml: power/temp/fan only, csv
+		// when selected via -metrics and successfully parsed, xml never -
+		// it has no equivalent XML fields at all)
+		if metricPresent(gpustat, "power.draw") {
+			appendFloatPoint(&buf, csvMetricRegistry["power.draw"], tags, gpustat.PowerDrawWatts, timestamp)
+		}
+		if metricPresent(gpustat, "temperature.gpu") {
+			appendFloatPoint(&buf, csvMetricRegistry["temperature.gpu"], tags, gpustat.TemperatureC, timestamp)
+		}
+		if metricPresent(gpustat, "fan.speed") {
+			appendFloatPoint(&buf, csvMetricRegistry["fan.speed"], tags, gpustat.FanSpeedPercent, timestamp)
+		}
+		if metricPresent(gpustat, "clocks.current.sm") {
+			appendPoint(&buf, csvMetricRegistry["clocks.current.sm"], tags, gpustat.ClockSMMHz, timestamp)
+		}
+		if metricPresent(gpustat, "clocks.current.memory") {
+			appendPoint(&buf, csvMetricRegistry["clocks.current.memory"], tags, gpustat.ClockMemoryMHz, timestamp)
+		}
+		if metricPresent(gpustat, "pstate") {
+			appendStringPoint(&buf, csvMetricRegistry["pstate"], tags, "state", gpustat.PerformanceState, timestamp)
+		}
+		// Per-process accounting
+		for _, proc := range gpustat.Processes {
+			proctags := fmt.Sprintf("%s,pid=%s,pname=%s,type=%s", tags, proc.PID, escapeLineProtocolTag(proc.ProcessName), proc.Type)
+			appendPoint(&buf, "gpu/process", proctags, proc.UsedMemory, timestamp)
+		}
+		// MIG partitions
+		for _, mig := range gpustat.MIGDevices {
+			migtags := fmt.Sprintf("%s,mig_uuid=%s,gpu_instance_id=%s", tags, mig.UUID, mig.GPUInstanceID)
+			appendPoint(&buf, "gpu/mig/fbmemory/used", migtags, mig.FBMemoryUsage.Used, timestamp)
+			appendPoint(&buf, "gpu/mig", migtags, mig.Utilization.GPUUtil, timestamp)
+		}
+		for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+			if len(line) > 0 {
+				lines = append(lines, string(line))
+			}
+		}
 	}
-
+	return lines
 }
 
+var (
+	backend          = flag.String("backend", "nvml", "GPU telemetry backend to use: nvml, csv, or xml")
+	mode             = flag.String("mode", "influx", "metrics sink to run: influx, prometheus, or both")
+	prometheusListen = flag.String("prometheus-addr", ":9400", "address the prometheus /metrics server listens on")
+	influxVersion    = flag.String("influx-version", "1", "InfluxDB API version to write to: 1 or 2")
+	influxToken      = flag.String("influx-token", "", "InfluxDB 2.x API token, sent as \"Authorization: Token ...\"")
+	influxOrg        = flag.String("influx-org", "", "InfluxDB 2.x organization")
+	influxBucket     = flag.String("influx-bucket", "", "InfluxDB 2.x bucket")
+	batchSize        = flag.Int("batch-size", 500, "flush to InfluxDB once this many points are buffered")
+	flushInterval    = flag.Duration("flush-interval", 5*time.Second, "how often to flush buffered points to InfluxDB")
+	metrics          = flag.String("metrics", "", "comma-separated nvidia-smi --query-gpu properties the csv backend should collect (default: a sensible built-in set, see csvMetricRegistry)")
+)
+
 func main() {
 	hostname, _ := os.Hostname()
 	influxdbAddr := os.Getenv("INFLUXDB_ADDR")
 	flag.Parse()
+
+	csvMetrics := defaultCSVMetrics
+	if *metrics != "" {
+		csvMetrics = strings.Split(*metrics, ",")
+	}
+
+	if *mode != "influx" && *mode != "prometheus" && *mode != "both" {
+		glog.Fatalf("unknown -mode %q, want one of influx, prometheus, both", *mode)
+	}
+
+	if *flushInterval <= 0 {
+		glog.Fatalf("-flush-interval must be positive, got %s", *flushInterval)
+	}
+
+	collector, err := NewCollector(*backend, csvMetrics)
+	if err != nil {
+		glog.Fatalf("can't build %q collector: %v", *backend, err)
+	}
+
+	snapshot := &gpuSnapshot{}
+	if *mode == "prometheus" || *mode == "both" {
+		go servePrometheus(*prometheusListen, hostname, snapshot)
+	}
+
+	var influx *influxClient
+	if *mode == "influx" || *mode == "both" {
+		influx = newInfluxClient(influxConfig{
+			BaseURL:       influxdbAddr,
+			Version:       *influxVersion,
+			Token:         *influxToken,
+			Org:           *influxOrg,
+			Bucket:        *influxBucket,
+			BatchSize:     *batchSize,
+			FlushInterval: *flushInterval,
+		})
+	}
+
 	for {
 		timestamp := time.Now().UnixNano()
-		infos, err := getGPUInfo()
+		infos, err := collector.Collect()
 		if err != nil {
 			glog.Errorf("get GPU info error: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		snapshot.Set(infos)
+		if influx != nil {
+			influx.Enqueue(buildInfluxLines(snapshot.Get(), hostname, timestamp))
 		}
-		postToInfluxdb(infos, influxdbAddr, hostname, timestamp)
 		time.Sleep(5 * time.Second)
 	}
 
@@ -0,0 +1,196 @@
+package main // GPU Monitor, feed data to influxdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// maxBufferedPoints caps how many unflushed line-protocol points we hold in
+// memory while the InfluxDB server is unreachable, so a long outage can't
+// grow the buffer without bound. Oldest points are dropped first.
+const maxBufferedPoints = 100000
+
+// influxConfig holds everything needed to address an InfluxDB 1.x or 2.x
+// server and batch writes to it.
+type influxConfig struct {
+	BaseURL       string
+	Version       string // "1" or "2"
+	Token         string
+	Org           string
+	Bucket        string
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// influxClient batches line-protocol points in memory and flushes them to
+// InfluxDB on a timer (or as soon as a batch fills up), retrying transient
+// failures with exponential backoff instead of dropping points on the first
+// error.
+type influxClient struct {
+	cfg        influxConfig
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	pending []string
+}
+
+func newInfluxClient(cfg influxConfig) *influxClient {
+	c := &influxClient{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if cfg.Version == "1" {
+		c.createDatabase()
+	}
+	go c.flushLoop()
+	return c
+}
+
+func (c *influxClient) createDatabase() {
+	url := c.cfg.BaseURL + "query?q=CREATE%20DATABASE%20GPU"
+	code, body := getURL(url)
+	if code != 200 {
+		glog.Errorf("create database faild, code %d, %s", code, body)
+	}
+}
+
+// Enqueue appends points to the pending batch, flushing immediately once
+// BatchSize is reached rather than waiting for the next timer tick.
+func (c *influxClient) Enqueue(points []string) {
+	if len(points) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.pending = append(c.pending, points...)
+	if over := len(c.pending) - maxBufferedPoints; over > 0 {
+		glog.Errorf("influx buffer full, dropping %d oldest points", over)
+		c.pending = c.pending[over:]
+	}
+	full := c.cfg.BatchSize > 0 && len(c.pending) >= c.cfg.BatchSize
+	c.mu.Unlock()
+	if full {
+		// Dispatched in its own goroutine so a slow/unreachable server
+		// (sendWithRetry sleeps 7.5s in total across its backoff schedule,
+		// plus up to the 10s HTTP timeout for each of its 5 attempts)
+		// doesn't stall the caller's collection loop.
+		go c.flush()
+	}
+}
+
+func (c *influxClient) flushLoop() {
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.flush()
+	}
+}
+
+// flush sends everything pending in one batched request. On failure the
+// points are left in (well, put back into) the pending queue so the next
+// tick retries them.
+func (c *influxClient) flush() {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	batch := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	if err := c.sendWithRetry(strings.Join(batch, "\n")); err != nil {
+		glog.Errorf("influx write failed after retries, re-buffering %d points: %v", len(batch), err)
+		c.mu.Lock()
+		c.pending = append(batch, c.pending...)
+		c.mu.Unlock()
+	}
+}
+
+// sendWithRetry posts body, retrying with exponential backoff on connection
+// errors and 5xx responses. 4xx responses are not retried since resending
+// the same malformed batch will never succeed.
+func (c *influxClient) sendWithRetry(body string) error {
+	const maxAttempts = 5
+	backoff := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		status, respBody, err := c.post(body)
+		if err == nil && status < 300 {
+			return nil
+		}
+		if err == nil && status < 500 {
+			return fmt.Errorf("influx rejected write, status %d: %s", status, respBody)
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("influx write status %d: %s", status, respBody)
+		}
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return lastErr
+}
+
+func (c *influxClient) writeURL() string {
+	if c.cfg.Version == "2" {
+		return fmt.Sprintf("%sapi/v2/write?org=%s&bucket=%s", c.cfg.BaseURL, c.cfg.Org, c.cfg.Bucket)
+	}
+	return c.cfg.BaseURL + "write?db=GPU"
+}
+
+func (c *influxClient) post(body string) (int, string, error) {
+	req, err := http.NewRequest("POST", c.writeURL(), strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if c.cfg.Version == "2" && c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.cfg.Token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "", err
+	}
+	return resp.StatusCode, string(respBody), nil
+}
+
+// escapeLineProtocolTag escapes commas, spaces and equals signs in a tag
+// key or value per the InfluxDB line protocol, so values like a
+// ProductName of "Tesla T4, 16GB" round-trip instead of corrupting the
+// point's tag set.
+func escapeLineProtocolTag(s string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		"=", `\=`,
+		" ", `\ `,
+	)
+	return replacer.Replace(s)
+}
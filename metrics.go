@@ -0,0 +1,67 @@
+package main // GPU Monitor, feed data to influxdb
+
+import "fmt"
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// csvIdentityFields are always queried by the csv backend regardless of
+// -metrics, since they're needed to populate a GPUInfo's identity rather
+// than a single measurement.
+var csvIdentityFields = []string{"index", "uuid", "name"}
+
+// csvMetricRegistry is the allow-list of nvidia-smi --query-gpu property
+// names the -metrics flag may select, mapped to the InfluxDB measurement
+// they're written under. Properties not in this list are rejected at
+// startup rather than passed through to nvidia-smi.
+var csvMetricRegistry = map[string]string{
+	"memory.total":          "fbmemory/total",
+	"memory.used":           "fbmemory/used",
+	"memory.free":           "fbmemory/free",
+	"utilization.gpu":       "gpu",
+	"utilization.memory":    "gpu/memutil",
+	"power.draw":            "gpu/power_draw_watts",
+	"temperature.gpu":       "gpu/temperature_celsius",
+	"fan.speed":             "gpu/fan_speed_percent",
+	"clocks.current.sm":     "gpu/clock_sm_mhz",
+	"clocks.current.memory": "gpu/clock_memory_mhz",
+	"pstate":                "gpu/pstate", // GPUInfo.PerformanceState, written as a string field, not a numeric one
+}
+
+// defaultCSVMetrics is used when -metrics is empty, matching the fields the
+// csv backend queried before -metrics existed.
+var defaultCSVMetrics = []string{
+	"memory.total", "memory.used", "memory.free",
+	"utilization.gpu", "utilization.memory",
+	"power.draw", "temperature.gpu", "fan.speed",
+	"clocks.current.sm", "clocks.current.memory", "pstate",
+}
+
+// validateCSVMetrics checks each requested property against
+// csvMetricRegistry, returning an error naming the first unknown one.
+func validateCSVMetrics(metrics []string) error {
+	for _, m := range metrics {
+		if _, ok := csvMetricRegistry[m]; !ok {
+			return fmt.Errorf("unknown -metrics property %q, want one of %v", m, csvMetricNames())
+		}
+	}
+	return nil
+}
+
+func csvMetricNames() []string {
+	names := make([]string, 0, len(csvMetricRegistry))
+	for name := range csvMetricRegistry {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,36 @@
+package main // GPU Monitor, feed data to influxdb
+
+import "sync"
+
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// gpuSnapshot holds the most recent Collector.Collect() result so that the
+// influx writer and the Prometheus exporter can both read it without each
+// shelling out / talking to NVML on their own schedule.
+type gpuSnapshot struct {
+	mu    sync.RWMutex
+	infos []GPUInfo
+}
+
+func (s *gpuSnapshot) Set(infos []GPUInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos = infos
+}
+
+func (s *gpuSnapshot) Get() []GPUInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.infos
+}